@@ -0,0 +1,63 @@
+package netpol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeIPTablesRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want []string
+	}{
+		{
+			name: "simple jump",
+			rule: `-A INPUT -m comment --comment "kube-router netpol" -j KUBE-ROUTER-INPUT`,
+			want: []string{"-A", "INPUT", "-m", "comment", "--comment", "kube-router netpol", "-j", "KUBE-ROUTER-INPUT"},
+		},
+		{
+			name: "multi-word comment survives as one token",
+			rule: `-A FORWARD -s 10.1.2.0/24 -m comment --comment "allow traffic to cluster IP" -j RETURN`,
+			want: []string{"-A", "FORWARD", "-s", "10.1.2.0/24", "-m", "comment", "--comment", "allow traffic to cluster IP", "-j", "RETURN"},
+		},
+		{
+			name: "no comment",
+			rule: `-A OUTPUT -j KUBE-ROUTER-OUTPUT`,
+			want: []string{"-A", "OUTPUT", "-j", "KUBE-ROUTER-OUTPUT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tokenizeIPTablesRule(tt.rule)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("tokenizeIPTablesRule(%q) = %v, want %v", tt.rule, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDenyByDefault(t *testing.T) {
+	tests := []struct {
+		mode      defaultNetworkPolicyMode
+		direction string
+		want      bool
+	}{
+		{defaultPolicyAllow, "INGRESS", false},
+		{defaultPolicyAllow, "EGRESS", false},
+		{defaultPolicyDenyAll, "INGRESS", true},
+		{defaultPolicyDenyAll, "EGRESS", true},
+		{defaultPolicyDenyIngress, "INGRESS", true},
+		{defaultPolicyDenyIngress, "EGRESS", false},
+		{defaultPolicyDenyEgress, "INGRESS", false},
+		{defaultPolicyDenyEgress, "EGRESS", true},
+	}
+
+	for _, tt := range tests {
+		npc := &NetworkPolicyController{defaultNetworkPolicy: tt.mode}
+		if got := npc.denyByDefault(tt.direction); got != tt.want {
+			t.Errorf("denyByDefault() with mode=%q direction=%q = %v, want %v", tt.mode, tt.direction, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package netpol
+
+import (
+	"reflect"
+
+	api "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/cloudnativelabs/kube-router/pkg/utils"
+)
+
+// newNodeEventHandler watches Node objects and keeps nodeIPs current for --allow-node-traffic: every
+// add/delete, and every update that changes a node's addresses, recomputes the full node IP allowlist
+// from nodeLister and pushes it through
+// UpdateNodeIPs before requesting a full sync, so kubelet health/readiness probes keep working against
+// a default-deny policy as nodes join, leave, or change address. The state update itself is not gated on
+// readyForUpdates (the first full sync needs to see a populated allowlist), only the sync request is.
+func (npc *NetworkPolicyController) newNodeEventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			npc.syncNodeIPs()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode := oldObj.(*api.Node)
+			newNode := newObj.(*api.Node)
+			if reflect.DeepEqual(oldNode.Status.Addresses, newNode.Status.Addresses) {
+				return
+			}
+			npc.syncNodeIPs()
+		},
+		DeleteFunc: func(obj interface{}) {
+			npc.syncNodeIPs()
+		},
+	}
+}
+
+// syncNodeIPs recomputes the full node IP allowlist from nodeLister, applies it via UpdateNodeIPs, and
+// requests a full sync to pick it up.
+func (npc *NetworkPolicyController) syncNodeIPs() {
+	var nodeIPs []string
+	for _, obj := range npc.nodeLister.List() {
+		node, ok := obj.(*api.Node)
+		if !ok {
+			continue
+		}
+		if nodeIP, err := utils.GetNodeIP(node); err == nil {
+			nodeIPs = append(nodeIPs, nodeIP.String())
+		}
+		if nodeIPv6, err := utils.GetNodeIPv6(node); err == nil {
+			nodeIPs = append(nodeIPs, nodeIPv6.String())
+		}
+	}
+	npc.UpdateNodeIPs(nodeIPs)
+	klog.V(2).InfoS("updated node IP allowlist for --allow-node-traffic", "count", len(nodeIPs))
+
+	if !npc.readyForUpdates {
+		return
+	}
+	npc.RequestFullSync()
+}
@@ -5,21 +5,62 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"net"
 	"reflect"
-	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cloudnativelabs/kube-router/pkg/healthcheck"
+	"github.com/cloudnativelabs/kube-router/pkg/metrics"
 	"github.com/cloudnativelabs/kube-router/pkg/utils"
 	"github.com/coreos/go-iptables/iptables"
-	"github.com/golang/glog"
 	api "k8s.io/api/core/v1"
 	networking "k8s.io/api/networking/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
 )
 
+// isIPv6 returns true if ip is an IPv6 address (as opposed to an IPv4 address
+// or an IPv4-mapped IPv6 address)
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// podIPsByFamily splits a pod's IPs (as reported in pod.Status.PodIPs, falling
+// back to the legacy pod.Status.PodIP) into IPv4 and IPv6 addresses
+func podIPsByFamily(pod *api.Pod) (ipv4 []string, ipv6 []string) {
+	podIPs := pod.Status.PodIPs
+	if len(podIPs) == 0 && pod.Status.PodIP != "" {
+		podIPs = []api.PodIP{{IP: pod.Status.PodIP}}
+	}
+	for _, podIP := range podIPs {
+		if podIP.IP == "" {
+			continue
+		}
+		if isIPv6(podIP.IP) {
+			ipv6 = append(ipv6, podIP.IP)
+		} else {
+			ipv4 = append(ipv4, podIP.IP)
+		}
+	}
+	return ipv4, ipv6
+}
+
+// isNetPolActionable returns true if a pod is in a state that can affect iptables/ipset state for
+// network policies: it has been assigned an IP, it is not running in the host network namespace, it
+// has not reached a terminal phase, and it is not already in the process of being deleted.
+func isNetPolActionable(pod *api.Pod) bool {
+	return len(pod.Status.PodIP) != 0 &&
+		!pod.Spec.HostNetwork &&
+		pod.Status.Phase != api.PodSucceeded &&
+		pod.Status.Phase != api.PodFailed &&
+		pod.DeletionTimestamp == nil
+}
+
 func (npc *NetworkPolicyController) newPodEventHandler() cache.ResourceEventHandler {
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -27,8 +68,11 @@ func (npc *NetworkPolicyController) newPodEventHandler() cache.ResourceEventHand
 				return
 			}
 			podObj := obj.(*api.Pod)
-			glog.V(2).Infof("Received pod:%s/%s add event", podObj.Namespace, podObj.Name)
-			npc.RequestFullSync()			
+			if !isNetPolActionable(podObj) {
+				return
+			}
+			klog.V(2).InfoS("received pod add event", "namespace", podObj.Namespace, "name", podObj.Name)
+			npc.RequestFullSync()
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			if !npc.readyForUpdates {
@@ -36,152 +80,86 @@ func (npc *NetworkPolicyController) newPodEventHandler() cache.ResourceEventHand
 			}
 			newPodObj := newObj.(*api.Pod)
 			oldPodObj := oldObj.(*api.Pod)
-			glog.V(2).Infof("Received pod:%s/%s update event", newPodObj.Namespace, newPodObj.Name)
-			// for the network policies, we are only interested in pod status phase change
-			// or IP change or change of pod labels
-			if newPodObj.Status.Phase != oldPodObj.Status.Phase ||
+
+			wasActionable := isNetPolActionable(oldPodObj)
+			isActionable := isNetPolActionable(newPodObj)
+
+			// a pod that cannot affect iptables/ipset state either side of the update can be ignored entirely
+			if !wasActionable && !isActionable {
+				return
+			}
+
+			klog.V(2).InfoS("received pod update event", "namespace", newPodObj.Namespace, "name", newPodObj.Name)
+
+			// trigger a full sync if the pod transitioned into or out of the actionable state, or if it
+			// stayed actionable but its IP or labels (which feed podSelector matching) changed
+			if wasActionable != isActionable ||
 				newPodObj.Status.PodIP != oldPodObj.Status.PodIP ||
 				!reflect.DeepEqual(newPodObj.Labels, oldPodObj.Labels) {
-					npc.RequestFullSync()			
-
+				npc.RequestFullSync()
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
 			if !npc.readyForUpdates {
 				return
 			}
-			npc.RequestFullSync()			
-
+			pod, ok := obj.(*api.Pod)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					klog.ErrorS(nil, "unexpected object type", "obj", obj)
+					return
+				}
+				if pod, ok = tombstone.Obj.(*api.Pod); !ok {
+					klog.ErrorS(nil, "unexpected object type", "obj", obj)
+					return
+				}
+			}
+			// unlike add/update, a delete must not be gated on phase/DeletionTimestamp: a pod that is
+			// actually being removed almost always has DeletionTimestamp set (graceful termination) or
+			// has reached a terminal phase by the time this fires, and still needs its KUBE-POD-FW-*
+			// chain and ipset membership torn down, or a reused IP inherits the dead pod's rules
+			if pod.Spec.HostNetwork || len(pod.Status.PodIP) == 0 {
+				return
+			}
+			klog.V(2).InfoS("received pod delete event", "namespace", pod.Namespace, "name", pod.Name)
+			npc.RequestFullSync()
 		},
 	}
 }
 
-/*
-func (npc *NetworkPolicyController) processPodAddUpdateEvents(pod *api.Pod) {
-
-	// skip processing update to pods in host network
-	if pod.Spec.HostNetwork {
-		return
-	}
-	// skip pods in trasient state
-	if len(pod.Status.PodIP) == 0 || pod.Status.PodIP == "" {
-		return
-	}
-
-	// if there is outstanding full-sync request the skip processing the event
-	if len(npc.fullSyncRequestChan) == cap(npc.fullSyncRequestChan) {
-		return
-	}
-
-	npc.mu.Lock()
-	defer npc.mu.Unlock()
-
-	iptablesCmdHandler, err := iptables.New()
-	if err != nil {
-		glog.Fatalf("Failed to initialize iptables executor: %s", err.Error())
-	}
-	podInfo := podInfo{ip: pod.Status.PodIP,
-		name:      pod.ObjectMeta.Name,
-		namespace: pod.ObjectMeta.Namespace,
-		labels:    pod.ObjectMeta.Labels}
-
-	podNamespacedName := pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name
-
-	err = npc.syncAffectedNetworkPolicyChains(&podInfo, syncVersion)
-	if err != nil {
-		glog.Errorf("failed to refresh network policy chains affected by pod:%s event due to %s", podNamespacedName, err.Error())
-	}
-
-	// only for local pods we need to setup pod firewall chains
-	if !isLocalPod(pod, npc.nodeIP.String()) {
-		return
-	}
-	networkPoliciesInfo, err := npc.buildNetworkPoliciesInfo()
-	if err != nil {
-		glog.Errorf("Failed to build network policies info due to %s", err.Error())
-	}
-	err = npc.syncPodFirewall(&podInfo, networkPoliciesInfo, syncVersion, iptablesCmdHandler)
-	if err != nil {
-		glog.Errorf("Failed to sync pod:%s firewall chain due to %s", podNamespacedName, err.Error())
-	}
-}
-*/
-
-// OnPodDelete handles delete of a pods event from the Kubernetes api server
-func (npc *NetworkPolicyController) processPodDeleteEvent(obj interface{}) {
-	pod, ok := obj.(*api.Pod)
-	if !ok {
-		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
-		if !ok {
-			glog.Errorf("unexpected object type: %v", obj)
-			return
-		}
-		if pod, ok = tombstone.Obj.(*api.Pod); !ok {
-			glog.Errorf("unexpected object type: %v", obj)
-			return
-		}
-	}
-	glog.V(2).Infof("Received pod:%s/%s delete event", pod.Namespace, pod.Name)
-
-	// skip processing update to pods in host network
-	if pod.Spec.HostNetwork {
-		return
-	}
-
-	// if there is outstanding full-sync request the skip processing the event
-	if len(npc.fullSyncRequestChan) == cap(npc.fullSyncRequestChan) {
-		return
-	}
-
-	npc.mu.Lock()
-	defer npc.mu.Unlock()
-
-	podInfo := podInfo{ip: pod.Status.PodIP,
-		name:      pod.ObjectMeta.Name,
-		namespace: pod.ObjectMeta.Namespace,
-		labels:    pod.ObjectMeta.Labels}
-
-	err := npc.syncAffectedNetworkPolicyChains(&podInfo, syncVersion)
-	if err != nil {
-		glog.Errorf("failed to refresh network policy chains affected by pod %s/%s delete event due to %s", pod.Namespace, pod.Name, err.Error())
-	}
-
-	// cleanup of firewall chains needed only for local pods
-	if !isLocalPod(pod, npc.nodeIP.String()) {
-		return
-	}
-
-	podFwChainName := podFirewallChainName(pod.Namespace, pod.Name, syncVersion)
-	iptablesCmdHandler, err := iptables.New()
-	if err != nil {
-		glog.Fatalf("Failed to initialize iptables executor: %s", err.Error())
-	}
-	topLevelChains := []string{kubeInputChainName, kubeForwardChainName, kubeOutputChainName}
-	for _, chain := range topLevelChains {
-		chainRules, err := iptablesCmdHandler.List("filter", chain)
-		if err != nil {
-			glog.Fatalf("failed to list rules in filter table, %s top level chain due to %s", chain, err.Error())
+// refreshIPSet diffs ips against the last-known member set for name (utils.DiffIPSetMembers) and
+// applies only the delta via incremental Add/Del calls instead of a full Refresh, falling back to a
+// full Refresh the first time name is seen (controller startup) so the cache starts from a known
+// state. It times the underlying ipset call and, when metrics are enabled, records its duration so
+// operators can see how much of a sync's latency comes from ipset restores.
+func (npc *NetworkPolicyController) refreshIPSet(set *utils.Set, name string, ips []string, extraArgs ...string) error {
+	start := time.Now()
+
+	add, del, known := utils.DiffIPSetMembers(name, ips)
+	var err error
+	if !known {
+		err = set.Refresh(ips, extraArgs...)
+	} else {
+		for _, ip := range del {
+			if delErr := set.Del(ip); delErr != nil {
+				err = delErr
+			}
 		}
-		var realRuleNo int
-		for i, rule := range chainRules {
-			if strings.Contains(rule, podFwChainName) {
-				err = iptablesCmdHandler.Delete("filter", chain, strconv.Itoa(i-realRuleNo))
-				if err != nil {
-					glog.Errorf("failed to delete rule: %s from the %s top level chian of filter table due to %s", rule, chain, err.Error())
-				}
-				realRuleNo++
+		for _, ip := range add {
+			if addErr := set.Add(ip, extraArgs...); addErr != nil {
+				err = addErr
 			}
 		}
 	}
-
-	err = iptablesCmdHandler.ClearChain("filter", podFwChainName)
 	if err != nil {
-		glog.Errorf("Failed to flush the rules in chain %s due to %s", podFwChainName, err.Error())
+		utils.InvalidateIPSetMembers(name)
 	}
-	err = iptablesCmdHandler.DeleteChain("filter", podFwChainName)
-	if err != nil {
-		glog.Errorf("Failed to delete the chain %s due to %s", podFwChainName, err.Error())
+
+	if npc.MetricsEnabled {
+		metrics.ControllerIpsetRestoreTime.Observe(time.Since(start).Seconds())
 	}
+	return err
 }
 
 // when a new pod added/deleted/updated this function ensures only matching network
@@ -201,35 +179,55 @@ func (npc *NetworkPolicyController) syncAffectedNetworkPolicyChains(pod *podInfo
 			if err != nil {
 				return err
 			}
-			matchingPodIps := make([]string, 0, len(matchingPods))
+			matchingPodIpsV4 := make([]string, 0, len(matchingPods))
+			matchingPodIpsV6 := make([]string, 0, len(matchingPods))
 			for _, matchingPod := range matchingPods {
-				if matchingPod.Status.PodIP == "" {
-					continue
-				}
-				matchingPodIps = append(matchingPodIps, matchingPod.Status.PodIP)
+				ipv4, ipv6 := podIPsByFamily(matchingPod)
+				matchingPodIpsV4 = append(matchingPodIpsV4, ipv4...)
+				matchingPodIpsV6 = append(matchingPodIpsV6, ipv6...)
 			}
 			if len(policy.Spec.Ingress) > 0 {
-				// create a ipset for all destination pod ip's matched by the policy spec target PodSelector
+				// create ipsets (v4 and v6) for all destination pod ip's matched by the policy spec target PodSelector
 				targetDestPodIPSetName := policyDestinationPodIPSetName(policy.Namespace, policy.Name)
 				targetDestPodIPSet, err := npc.ipSetHandler.Create(targetDestPodIPSetName, utils.TypeHashIP, utils.OptionTimeout, "0")
 				if err != nil {
 					return fmt.Errorf("failed to create ipset: %s", err.Error())
 				}
-				err = targetDestPodIPSet.Refresh(matchingPodIps, utils.OptionTimeout, "0")
+				err = npc.refreshIPSet(targetDestPodIPSet, targetDestPodIPSetName, matchingPodIpsV4, utils.OptionTimeout, "0")
 				if err != nil {
-					glog.Errorf("failed to refresh targetDestPodIPSet,: " + err.Error())
+					klog.ErrorS(err, "failed to refresh targetDestPodIPSet")
+				}
+				if npc.ipSetHandlerV6 != nil {
+					targetDestPodIPSet6, err := npc.ipSetHandlerV6.Create(targetDestPodIPSetName+"-v6", utils.TypeHashIP, utils.OptionTimeout, "0")
+					if err != nil {
+						return fmt.Errorf("failed to create ipv6 ipset: %s", err.Error())
+					}
+					err = npc.refreshIPSet(targetDestPodIPSet6, targetDestPodIPSetName+"-v6", matchingPodIpsV6, utils.OptionTimeout, "0")
+					if err != nil {
+						klog.ErrorS(err, "failed to refresh targetDestPodIPSet", "family", "ipv6")
+					}
 				}
 			}
 			if len(policy.Spec.Egress) > 0 {
-				// create a ipset for all source pod ip's matched by the policy spec target PodSelector
+				// create ipsets (v4 and v6) for all source pod ip's matched by the policy spec target PodSelector
 				targetSourcePodIPSetName := policySourcePodIPSetName(policy.Namespace, policy.Name)
 				targetSourcePodIPSet, err := npc.ipSetHandler.Create(targetSourcePodIPSetName, utils.TypeHashIP, utils.OptionTimeout, "0")
 				if err != nil {
 					return fmt.Errorf("failed to create ipset: %s", err.Error())
 				}
-				err = targetSourcePodIPSet.Refresh(matchingPodIps, utils.OptionTimeout, "0")
+				err = npc.refreshIPSet(targetSourcePodIPSet, targetSourcePodIPSetName, matchingPodIpsV4, utils.OptionTimeout, "0")
 				if err != nil {
-					glog.Errorf("failed to refresh targetSourcePodIPSet: " + err.Error())
+					klog.ErrorS(err, "failed to refresh targetSourcePodIPSet")
+				}
+				if npc.ipSetHandlerV6 != nil {
+					targetSourcePodIPSet6, err := npc.ipSetHandlerV6.Create(targetSourcePodIPSetName+"-v6", utils.TypeHashIP, utils.OptionTimeout, "0")
+					if err != nil {
+						return fmt.Errorf("failed to create ipv6 ipset: %s", err.Error())
+					}
+					err = npc.refreshIPSet(targetSourcePodIPSet6, targetSourcePodIPSetName+"-v6", matchingPodIpsV6, utils.OptionTimeout, "0")
+					if err != nil {
+						klog.ErrorS(err, "failed to refresh targetSourcePodIPSet", "family", "ipv6")
+					}
 				}
 			}
 		}
@@ -276,9 +274,9 @@ func (npc *NetworkPolicyController) syncAffectedNetworkPolicyChains(pod *podInfo
 				if err != nil {
 					return fmt.Errorf("failed to create ipset: %s", err.Error())
 				}
-				err = srcPodIPSet.Refresh(ingressRuleSrcPodIPs)
+				err = npc.refreshIPSet(srcPodIPSet, srcPodIPSetName, ingressRuleSrcPodIPs)
 				if err != nil {
-					glog.Errorf("failed to refresh srcPodIPSet: " + err.Error())
+					klog.ErrorS(err, "failed to refresh srcPodIPSet")
 				}
 			}
 		}
@@ -325,23 +323,28 @@ func (npc *NetworkPolicyController) syncAffectedNetworkPolicyChains(pod *podInfo
 				if err != nil {
 					return fmt.Errorf("failed to create ipset: %s", err.Error())
 				}
-				err = dstPodIPSet.Refresh(egressRuleDstPodIps)
+				err = npc.refreshIPSet(dstPodIPSet, dstPodIPSetName, egressRuleDstPodIps)
 				if err != nil {
-					glog.Errorf("failed to refresh srcPodIPSet: " + err.Error())
+					klog.ErrorS(err, "failed to refresh srcPodIPSet")
 				}
 			}
 		}
 	}
+	healthcheck.SendHeartBeat(npc.HealthChan, "NPC")
 	return nil
 }
 
-func (npc *NetworkPolicyController) fullSyncPodFirewallChains(currentFilterTable *bytes.Buffer, networkPoliciesInfo []networkPolicyInfo, version string) (map[string]bool, error) {
+func (npc *NetworkPolicyController) fullSyncPodFirewallChains(currentFilterTable, currentFilterTable6 *bytes.Buffer, networkPoliciesInfo []networkPolicyInfo, version string) (map[string]bool, error) {
 
 	activePodFwChains := make(map[string]bool)
 
 	iptablesCmdHandler, err := iptables.New()
 	if err != nil {
-		glog.Fatalf("Failed to initialize iptables executor: %s", err.Error())
+		klog.ErrorS(err, "failed to initialize iptables executor")
+	}
+	ip6tablesCmdHandler, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		klog.ErrorS(err, "failed to initialize ip6tables executor, IPv6 pods will not get firewall rules")
 	}
 
 	allLocalPods, err := npc.getLocalPods(npc.nodeIP.String())
@@ -350,53 +353,64 @@ func (npc *NetworkPolicyController) fullSyncPodFirewallChains(currentFilterTable
 	}
 	for _, pod := range *allLocalPods {
 		podFwChainName := podFirewallChainName(pod.namespace, pod.name, version)
-		currentFilterTable.WriteString(":"+podFwChainName+"\n")
+		currentFilterTable.WriteString(":" + podFwChainName + " - [0:0]\n")
+		currentFilterTable6.WriteString(":" + podFwChainName + " - [0:0]\n")
 
 		activePodFwChains[podFwChainName] = true
-		err = npc.syncPodFirewall(currentFilterTable, &pod, networkPoliciesInfo, version, iptablesCmdHandler)
+		klog.V(2).InfoS("building pod firewall chain", "namespace", pod.namespace, "name", pod.name, "chain", podFwChainName)
+		err = npc.syncPodFirewall(currentFilterTable, currentFilterTable6, &pod, networkPoliciesInfo, version, iptablesCmdHandler, ip6tablesCmdHandler)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to sync pod firewall: %s", err.Error())
 		}
 	}
 
+	healthcheck.SendHeartBeat(npc.HealthChan, "NPC")
 	return activePodFwChains, nil
 }
 
-func (npc *NetworkPolicyController) syncPodFirewall(currentFilterTable *bytes.Buffer, pod *podInfo, networkPoliciesInfo []networkPolicyInfo, version string, iptablesCmdHandler *iptables.IPTables) error {
+// filterTableForIP returns the filter table buffer that the rules for ip belong in
+func filterTableForIP(ip string, currentFilterTable, currentFilterTable6 *bytes.Buffer) *bytes.Buffer {
+	if isIPv6(ip) {
+		return currentFilterTable6
+	}
+	return currentFilterTable
+}
+
+func (npc *NetworkPolicyController) syncPodFirewall(currentFilterTable, currentFilterTable6 *bytes.Buffer, pod *podInfo, networkPoliciesInfo []networkPolicyInfo, version string, iptablesCmdHandler, ip6tablesCmdHandler *iptables.IPTables) error {
 	podFwChainName := podFirewallChainName(pod.namespace, pod.name, version)
 
 	// setup rules to run pod inbound traffic through applicable ingress network policies
-	err := npc.setupPodIngressRules(pod, podFwChainName, networkPoliciesInfo, currentFilterTable, version)
+	err := npc.setupPodIngressRules(pod, podFwChainName, networkPoliciesInfo, currentFilterTable, currentFilterTable6, version)
 	if err != nil {
 		return err
 	}
 
 	// setup rules to run pod outbound traffic through applicable egress network policies
-	err = npc.setupPodEgressRules(pod, podFwChainName, networkPoliciesInfo, currentFilterTable, version)
+	err = npc.setupPodEgressRules(pod, podFwChainName, networkPoliciesInfo, currentFilterTable, currentFilterTable6, version)
 	if err != nil {
 		return err
 	}
 
 	// setup rules to drop the traffic from/to the pods that is not expliclty whitelisted
-	err = npc.processNonWhitelistedTrafficRules(pod.name, pod.namespace, podFwChainName, currentFilterTable)
+	err = npc.processNonWhitelistedTrafficRules(pod.name, pod.namespace, podFwChainName, currentFilterTable, currentFilterTable6)
 	if err != nil {
 		return err
 	}
 
 	// setup rules to process the traffic from/to the pods that is whitelisted
-	err = npc.processWhitelistedTrafficRules(pod.name, pod.namespace, podFwChainName, currentFilterTable)
+	err = npc.processWhitelistedTrafficRules(pod.name, pod.namespace, podFwChainName, currentFilterTable, currentFilterTable6)
 	if err != nil {
 		return err
 	}
 
 	// setup rules to intercept inbound traffic to the pods
-	err = npc.interceptPodInboundTraffic(pod, podFwChainName, currentFilterTable)
+	err = npc.interceptPodInboundTraffic(pod, podFwChainName, currentFilterTable, currentFilterTable6)
 	if err != nil {
 		return err
 	}
 
 	// setup rules to intercept outbound traffic from the pods
-	err = npc.interceptPodOutboundTraffic(pod, podFwChainName, currentFilterTable)
+	err = npc.interceptPodOutboundTraffic(pod, podFwChainName, currentFilterTable, currentFilterTable6)
 	if err != nil {
 		return err
 	}
@@ -404,63 +418,79 @@ func (npc *NetworkPolicyController) syncPodFirewall(currentFilterTable *bytes.Bu
 	return nil
 }
 
+// podIPs returns the dual-stack IPs for the pod, falling back to the legacy single pod.ip
+func podIPs(pod *podInfo) []string {
+	if len(pod.ips) > 0 {
+		return pod.ips
+	}
+	return []string{pod.ip}
+}
+
 // setup iptable rules to intercept inbound traffic to pods and run it across the
 // firewall chain corresponding to the pod so that ingress network policies are enforced
-func (npc *NetworkPolicyController) interceptPodInboundTraffic(pod *podInfo, podFwChainName string, currentFilterTable *bytes.Buffer) error {
-	// ensure there is rule in filter table and FORWARD chain to jump to pod specific firewall chain
-	// this rule applies to the traffic getting routed (coming for other node pods)
-	comment := "\"rule to jump traffic destined to POD name:" + pod.name + " namespace: " + pod.namespace +
-		" to chain " + podFwChainName + "\""
-	args := []string{"-I", kubeForwardChainName, "1", "-m", "comment", "--comment", comment, "-d", pod.ip, "-j", podFwChainName, "\n"}
-	currentFilterTable.WriteString(strings.Join(args, " "))
+func (npc *NetworkPolicyController) interceptPodInboundTraffic(pod *podInfo, podFwChainName string, currentFilterTable, currentFilterTable6 *bytes.Buffer) error {
+	for _, ip := range podIPs(pod) {
+		table := filterTableForIP(ip, currentFilterTable, currentFilterTable6)
 
-	// ensure there is rule in filter table and OUTPUT chain to jump to pod specific firewall chain
-	// this rule applies to the traffic from a pod getting routed back to another pod on same node by service proxy
-	args = []string{"-I", kubeOutputChainName, "1", "-m", "comment", "--comment", comment, "-d", pod.ip, "-j", podFwChainName, "\n"}
-	currentFilterTable.WriteString(strings.Join(args, " "))
+		// ensure there is rule in filter table and FORWARD chain to jump to pod specific firewall chain
+		// this rule applies to the traffic getting routed (coming for other node pods)
+		comment := "\"rule to jump traffic destined to POD name:" + pod.name + " namespace: " + pod.namespace +
+			" to chain " + podFwChainName + "\""
+		args := []string{"-I", kubeForwardChainName, "1", "-m", "comment", "--comment", comment, "-d", ip, "-j", podFwChainName, "\n"}
+		table.WriteString(strings.Join(args, " "))
 
-	// ensure there is rule in filter table and forward chain to jump to pod specific firewall chain
-	// this rule applies to the traffic getting switched (coming for same node pods)
-	comment = "\"rule to jump traffic destined to POD name:" + pod.name + " namespace: " + pod.namespace +
-		" to chain " + podFwChainName + "\""
-	args = []string{"-I", kubeForwardChainName, "1", "-m", "physdev", "--physdev-is-bridged",
-		"-m", "comment", "--comment", comment,
-		"-d", pod.ip,
-		"-j", podFwChainName, "\n"}
-	currentFilterTable.WriteString(strings.Join(args, " "))
+		// ensure there is rule in filter table and OUTPUT chain to jump to pod specific firewall chain
+		// this rule applies to the traffic from a pod getting routed back to another pod on same node by service proxy
+		args = []string{"-I", kubeOutputChainName, "1", "-m", "comment", "--comment", comment, "-d", ip, "-j", podFwChainName, "\n"}
+		table.WriteString(strings.Join(args, " "))
+
+		// ensure there is rule in filter table and forward chain to jump to pod specific firewall chain
+		// this rule applies to the traffic getting switched (coming for same node pods)
+		comment = "\"rule to jump traffic destined to POD name:" + pod.name + " namespace: " + pod.namespace +
+			" to chain " + podFwChainName + "\""
+		args = []string{"-I", kubeForwardChainName, "1", "-m", "physdev", "--physdev-is-bridged",
+			"-m", "comment", "--comment", comment,
+			"-d", ip,
+			"-j", podFwChainName, "\n"}
+		table.WriteString(strings.Join(args, " "))
+	}
 
 	return nil
 }
 
 // setup iptable rules to intercept outbound traffic from pods and run it across the
 // firewall chain corresponding to the pod so that egress network policies are enforced
-func (npc *NetworkPolicyController) interceptPodOutboundTraffic(pod *podInfo, podFwChainName string, currentFilterTable *bytes.Buffer) error {
+func (npc *NetworkPolicyController) interceptPodOutboundTraffic(pod *podInfo, podFwChainName string, currentFilterTable, currentFilterTable6 *bytes.Buffer) error {
 	egressFilterChains := []string{kubeInputChainName, kubeForwardChainName, kubeOutputChainName}
-	for _, chain := range egressFilterChains {
-		// ensure there is rule in filter table and FORWARD chain to jump to pod specific firewall chain
-		// this rule applies to the traffic getting forwarded/routed (traffic from the pod destinted
-		// to pod on a different node)
+	for _, ip := range podIPs(pod) {
+		table := filterTableForIP(ip, currentFilterTable, currentFilterTable6)
+
+		for _, chain := range egressFilterChains {
+			// ensure there is rule in filter table and FORWARD chain to jump to pod specific firewall chain
+			// this rule applies to the traffic getting forwarded/routed (traffic from the pod destinted
+			// to pod on a different node)
+			comment := "\"rule to jump traffic from POD name:" + pod.name + " namespace: " + pod.namespace +
+				" to chain " + podFwChainName + "\""
+			args := []string{"-I", chain, "1", "-m", "comment", "--comment", comment, "-s", ip, "-j", podFwChainName, "\n"}
+			table.WriteString(strings.Join(args, " "))
+		}
+
+		// ensure there is rule in filter table and forward chain to jump to pod specific firewall chain
+		// this rule applies to the traffic getting switched (coming for same node pods)
 		comment := "\"rule to jump traffic from POD name:" + pod.name + " namespace: " + pod.namespace +
 			" to chain " + podFwChainName + "\""
-		args := []string{"-I", chain, "1", "-m", "comment", "--comment", comment, "-s", pod.ip, "-j", podFwChainName, "\n"}
-		currentFilterTable.WriteString(strings.Join(args, " "))
+		args := []string{"-I", kubeForwardChainName, "1", "-m", "physdev", "--physdev-is-bridged",
+			"-m", "comment", "--comment", comment,
+			"-s", ip,
+			"-j", podFwChainName, "\n"}
+		table.WriteString(strings.Join(args, " "))
 	}
 
-	// ensure there is rule in filter table and forward chain to jump to pod specific firewall chain
-	// this rule applies to the traffic getting switched (coming for same node pods)
-	comment := "\"rule to jump traffic from POD name:" + pod.name + " namespace: " + pod.namespace +
-		" to chain " + podFwChainName + "\""
-	args := []string{"-I", kubeForwardChainName, "1", "-m", "physdev", "--physdev-is-bridged",
-		"-m", "comment", "--comment", comment,
-		"-s", pod.ip,
-		"-j", podFwChainName, "\n"}
-	currentFilterTable.WriteString(strings.Join(args, " "))
-
 	return nil
 }
 
 // setup rules to jump to applicable network policy chaings for the pod inbound traffic
-func (npc *NetworkPolicyController) setupPodIngressRules(pod *podInfo, podFwChainName string, networkPoliciesInfo []networkPolicyInfo, currentFilterTable *bytes.Buffer, version string) error {
+func (npc *NetworkPolicyController) setupPodIngressRules(pod *podInfo, podFwChainName string, networkPoliciesInfo []networkPolicyInfo, currentFilterTable, currentFilterTable6 *bytes.Buffer, version string) error {
 	var ingressPoliciesPresent bool
 	// add entries in pod firewall to run through required network policies
 	for _, policy := range networkPoliciesInfo {
@@ -472,28 +502,53 @@ func (npc *NetworkPolicyController) setupPodIngressRules(pod *podInfo, podFwChai
 		policyChainName := networkPolicyChainName(policy.namespace, policy.name, version)
 		args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment, "-j", policyChainName, "\n"}
 		currentFilterTable.WriteString(strings.Join(args, " "))
-	}
+		// NOTE: fullSyncNetworkPolicyChains only renders KUBE-NWPLCY-* chains (and their KUBE-SRC-/
+		// KUBE-DST- ipsets) into the v4 filter table today, so a v6 jump to policyChainName here would
+		// reference a chain that was never declared and fail the entire ip6tables-restore transaction.
+		// Leave IPv6 pods falling through to defaultIngressChain below until that renderer is made
+		// dual-stack aware, rather than breaking ip6tables-restore for every dual-stack node.
+	}
+
+	defaultIngressChain := npc.defaultChainFor(pod.namespace, "INGRESS")
+
+	for _, ip := range podIPs(pod) {
+		table := filterTableForIP(ip, currentFilterTable, currentFilterTable6)
+		// the policy jump above is never rendered for v6 (see NOTE), so a v6 IP must fall through to
+		// the default chain even when a policy targets this pod and skipped ingressPoliciesPresent's
+		// v4-only jump, or non-established v6 ingress would be silently REJECTed with no jump at all
+		if !ingressPoliciesPresent || isIPv6(ip) {
+			comment := "\"run through default ingress policy  chain\""
+			args := []string{"-I", podFwChainName, "1", "-d", ip, "-m", "comment", "--comment", comment, "-j", defaultIngressChain, "\n"}
+			table.WriteString(strings.Join(args, " "))
+		}
 
-	if !ingressPoliciesPresent {
-		comment := "\"run through default ingress policy  chain\""
-		args := []string{"-I", podFwChainName, "1", "-d", pod.ip, "-m", "comment", "--comment", comment, "-j", kubeIngressNetpolChain, "\n"}
-		currentFilterTable.WriteString(strings.Join(args, " "))
+		comment := "\"rule to permit the traffic traffic to pods when source is the pod's local node\""
+		args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment, "-m", "addrtype", "--src-type", "LOCAL", "-d", ip, "-j", "ACCEPT", "\n"}
+		table.WriteString(strings.Join(args, " "))
 	}
 
-	comment := "\"rule to permit the traffic traffic to pods when source is the pod's local node\""
-	args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment, "-m", "addrtype", "--src-type", "LOCAL", "-d", pod.ip, "-j", "ACCEPT", "\n"}
-	currentFilterTable.WriteString(strings.Join(args, " "))
+	// allow ingress from the pod's node(s) so default-deny policies don't break kubelet health and
+	// readiness probes; addrtype LOCAL above only covers the node the pod is scheduled on, this
+	// whitelists every node in the cluster
+	if npc.allowNodeTraffic {
+		for _, nodeIP := range npc.nodeIPs {
+			comment := "\"allow ingress from node traffic (--allow-node-traffic)\""
+			args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment, "-s", nodeIP, "-j", "ACCEPT", "\n"}
+			filterTableForIP(nodeIP, currentFilterTable, currentFilterTable6).WriteString(strings.Join(args, " "))
+		}
+	}
 
 	// ensure statefull firewall, that permits return traffic for the traffic originated by the pod
-	comment = "\"rule for stateful firewall for pod\""
-	args = []string{"-I", podFwChainName, "1",  "-m", "comment", "--comment", comment, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT", "\n"}
+	comment := "\"rule for stateful firewall for pod\""
+	args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT", "\n"}
 	currentFilterTable.WriteString(strings.Join(args, " "))
+	currentFilterTable6.WriteString(strings.Join(args, " "))
 
 	return nil
 }
 
 // setup rules to jump to applicable network policy chains for the pod outbound traffic
-func (npc *NetworkPolicyController) setupPodEgressRules(pod *podInfo, podFwChainName string, networkPoliciesInfo []networkPolicyInfo, currentFilterTable *bytes.Buffer, version string) error {
+func (npc *NetworkPolicyController) setupPodEgressRules(pod *podInfo, podFwChainName string, networkPoliciesInfo []networkPolicyInfo, currentFilterTable, currentFilterTable6 *bytes.Buffer, version string) error {
 	var egressPoliciesPresent bool
 	// add entries in pod firewall to run through required network policies
 	for _, policy := range networkPoliciesInfo {
@@ -505,51 +560,82 @@ func (npc *NetworkPolicyController) setupPodEgressRules(pod *podInfo, podFwChain
 		policyChainName := networkPolicyChainName(policy.namespace, policy.name, version)
 		args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment, "-j", policyChainName, "\n"}
 		currentFilterTable.WriteString(strings.Join(args, " "))
-
+		// NOTE: fullSyncNetworkPolicyChains only renders KUBE-NWPLCY-* chains (and their KUBE-SRC-/
+		// KUBE-DST- ipsets) into the v4 filter table today, so a v6 jump to policyChainName here would
+		// reference a chain that was never declared and fail the entire ip6tables-restore transaction.
+		// Leave IPv6 pods falling through to defaultEgressChain below until that renderer is made
+		// dual-stack aware, rather than breaking ip6tables-restore for every dual-stack node.
+	}
+
+	defaultEgressChain := npc.defaultChainFor(pod.namespace, "EGRESS")
+
+	for _, ip := range podIPs(pod) {
+		table := filterTableForIP(ip, currentFilterTable, currentFilterTable6)
+		// the policy jump above is never rendered for v6 (see NOTE), so a v6 IP must fall through to
+		// the default chain even when a policy targets this pod and skipped egressPoliciesPresent's
+		// v4-only jump, or non-established v6 egress would be silently REJECTed with no jump at all
+		if !egressPoliciesPresent || isIPv6(ip) {
+			comment := "\"run through default egress policy  chain\""
+			args := []string{"-I", podFwChainName, "1", "-s", ip, "-m", "comment", "--comment", comment, "-j", defaultEgressChain, "\n"}
+			table.WriteString(strings.Join(args, " "))
+		}
 	}
 
-	if !egressPoliciesPresent {
-		comment := "\"run through default egress policy  chain\""
-		args := []string{"-I", podFwChainName, "1", "-s", pod.ip, "-m", "comment", "--comment", comment, "-j", kubeEgressNetpolChain, "\n"}
-		currentFilterTable.WriteString(strings.Join(args, " "))
-
+	// allow egress to cluster DNS and any node-local DNS listener on UDP/TCP 53 so default-deny
+	// policies don't break DNS resolution for pods that don't otherwise allow it
+	if npc.allowDNSTraffic {
+		dnsIPs := append(append([]string{}, npc.dnsServiceIPs...), npc.nodeLocalDNSIPs...)
+		for _, dnsIP := range dnsIPs {
+			table := filterTableForIP(dnsIP, currentFilterTable, currentFilterTable6)
+			for _, proto := range []string{"udp", "tcp"} {
+				comment := "\"allow egress to cluster DNS (--allow-dns-traffic)\""
+				args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment,
+					"-p", proto, "-d", dnsIP, "--dport", "53", "-j", "ACCEPT", "\n"}
+				table.WriteString(strings.Join(args, " "))
+			}
+		}
 	}
 
 	// ensure statefull firewall, that permits return traffic for the traffic originated by the pod
 	comment := "\"rule for stateful firewall for pod\""
 	args := []string{"-I", podFwChainName, "1", "-m", "comment", "--comment", comment, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT", "\n"}
 	currentFilterTable.WriteString(strings.Join(args, " "))
+	currentFilterTable6.WriteString(strings.Join(args, " "))
 
 	return nil
 }
 
-func (npc *NetworkPolicyController) processNonWhitelistedTrafficRules(podName, podNamespace, podFwChainName string, currentFilterTable *bytes.Buffer) error {
+func (npc *NetworkPolicyController) processNonWhitelistedTrafficRules(podName, podNamespace, podFwChainName string, currentFilterTable, currentFilterTable6 *bytes.Buffer) error {
 	// add rule to log the packets that will be dropped due to network policy enforcement
 	comment := "\"rule to log dropped traffic POD name:" + podName + " namespace: " + podNamespace + "\""
 	args := []string{"-A", podFwChainName, "-m", "comment", "--comment", comment, "-m", "mark", "!", "--mark", "0x10000/0x10000", "-j", "NFLOG", "--nflog-group", "100", "-m", "limit", "--limit", "10/minute", "--limit-burst", "10", "\n"}
 	currentFilterTable.WriteString(strings.Join(args, " "))
+	currentFilterTable6.WriteString(strings.Join(args, " "))
 
 	// add rule to DROP if no applicable network policy permits the traffic
 	comment = "\"rule to REJECT traffic destined for POD name:" + podName + " namespace: " + podNamespace + "\""
 	args = []string{"-A", podFwChainName, "-m", "comment", "--comment", comment, "-m", "mark", "!", "--mark", "0x10000/0x10000", "-j", "REJECT", "\n"}
 	currentFilterTable.WriteString(strings.Join(args, " "))
+	currentFilterTable6.WriteString(strings.Join(args, " "))
 
 	return nil
 }
 
-func (npc *NetworkPolicyController) processWhitelistedTrafficRules(podName, podNamespace, podFwChainName string, currentFilterTable *bytes.Buffer) error {
+func (npc *NetworkPolicyController) processWhitelistedTrafficRules(podName, podNamespace, podFwChainName string, currentFilterTable, currentFilterTable6 *bytes.Buffer) error {
 	// if the traffic is whitelisted, reset mark to let traffic pass through
 	// matching pod firewall chains (only case this happens is when source
 	// and destination are on the same pod in which policies for both the pods
 	// need to be run through)
 	args := []string{"-A", podFwChainName, "-j", "MARK", "--set-mark", "0/0x10000", "\n"}
 	currentFilterTable.WriteString(strings.Join(args, " "))
+	currentFilterTable6.WriteString(strings.Join(args, " "))
 
 	// set mark to indicate traffic passed network policies. Mark will be
 	// checked to ACCEPT the traffic
 	comment := "\"set mark to ACCEPT traffic that comply to network policies\""
 	args = []string{"-A", podFwChainName, "-m", "comment", "--comment", comment, "-j", "MARK", "--set-mark", "0x20000/0x20000", "\n"}
 	currentFilterTable.WriteString(strings.Join(args, " "))
+	currentFilterTable6.WriteString(strings.Join(args, " "))
 
 	return nil
 }
@@ -572,7 +658,10 @@ func (npc *NetworkPolicyController) getLocalPods(nodeIP string) (*map[string]pod
 		if len(pod.Status.PodIP) == 0 || pod.Status.PodIP == "" {
 			continue
 		}
+
+		ipv4, ipv6 := podIPsByFamily(pod)
 		localPods[pod.Status.PodIP] = podInfo{ip: pod.Status.PodIP,
+			ips:       append(ipv4, ipv6...),
 			name:      pod.ObjectMeta.Name,
 			namespace: pod.ObjectMeta.Namespace,
 			labels:    pod.ObjectMeta.Labels}
@@ -0,0 +1,97 @@
+package netpol
+
+import (
+	"reflect"
+
+	api "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// kubeDNSServiceLabelKey/-Value identify the cluster DNS Service whose ClusterIP(s) --allow-dns-traffic
+// whitelists. CoreDNS deployments retain this label for kube-dns compatibility, so it identifies the
+// cluster DNS service regardless of which DNS provider a cluster runs.
+const (
+	kubeDNSServiceLabelKey   = "k8s-app"
+	kubeDNSServiceLabelValue = "kube-dns"
+)
+
+// isDNSService returns whether svc is the cluster DNS Service that --allow-dns-traffic whitelists
+func isDNSService(svc *api.Service) bool {
+	return svc.Labels[kubeDNSServiceLabelKey] == kubeDNSServiceLabelValue
+}
+
+// dnsServiceClusterIPs returns every ClusterIP (dual-stack aware) svc resolves to, or nil for a
+// headless service
+func dnsServiceClusterIPs(svc *api.Service) []string {
+	if svc.Spec.ClusterIP == api.ClusterIPNone {
+		return nil
+	}
+	if len(svc.Spec.ClusterIPs) > 0 {
+		return append([]string(nil), svc.Spec.ClusterIPs...)
+	}
+	if svc.Spec.ClusterIP == "" {
+		return nil
+	}
+	return []string{svc.Spec.ClusterIP}
+}
+
+// newServiceEventHandler watches Service objects and keeps dnsServiceIPs current for
+// --allow-dns-traffic. Every Service but the cluster DNS one (identified by isDNSService) is ignored;
+// the DNS service's ClusterIP(s) are recomputed on add/update/delete and pushed through
+// UpdateDNSServiceIPs before requesting a full sync, so default-deny policies don't break DNS lookups
+// as the DNS Service is created, changes ClusterIP (e.g. an IPv4/IPv6 dual-stack conversion), or is
+// removed.
+func (npc *NetworkPolicyController) newServiceEventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			svc := obj.(*api.Service)
+			if !isDNSService(svc) {
+				return
+			}
+			npc.syncDNSServiceIPs(dnsServiceClusterIPs(svc))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			newSvc := newObj.(*api.Service)
+			if !isDNSService(newSvc) {
+				return
+			}
+			oldSvc := oldObj.(*api.Service)
+			if reflect.DeepEqual(dnsServiceClusterIPs(oldSvc), dnsServiceClusterIPs(newSvc)) {
+				return
+			}
+			npc.syncDNSServiceIPs(dnsServiceClusterIPs(newSvc))
+		},
+		DeleteFunc: func(obj interface{}) {
+			svc, ok := obj.(*api.Service)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					klog.ErrorS(nil, "unexpected object type", "obj", obj)
+					return
+				}
+				if svc, ok = tombstone.Obj.(*api.Service); !ok {
+					klog.ErrorS(nil, "unexpected object type", "obj", obj)
+					return
+				}
+			}
+			if !isDNSService(svc) {
+				return
+			}
+			npc.syncDNSServiceIPs(nil)
+		},
+	}
+}
+
+// syncDNSServiceIPs applies ips as the new DNS Service allowlist via UpdateDNSServiceIPs and requests a
+// full sync to pick it up. The state update itself is not gated on readyForUpdates (the first full sync
+// needs to see a populated allowlist), only the sync request is.
+func (npc *NetworkPolicyController) syncDNSServiceIPs(ips []string) {
+	npc.UpdateDNSServiceIPs(ips)
+	klog.V(2).InfoS("updated cluster DNS service IP allowlist for --allow-dns-traffic", "ips", ips)
+
+	if !npc.readyForUpdates {
+		return
+	}
+	npc.RequestFullSync()
+}
@@ -0,0 +1,96 @@
+// Package healthcheck lets kube-router's controllers report liveness on a shared channel so that an
+// HTTP handler can answer Kubernetes liveness probes without each controller running its own server.
+package healthcheck
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ControllerHeartbeat carries the name of the controller that is alive and the time it sent the
+// heartbeat, so the health controller can tell a live controller from one that has gone silent
+type ControllerHeartbeat struct {
+	Component     string
+	LastHeartBeat time.Time
+}
+
+// SendHeartBeat sends a heartbeat for component on healthChan without blocking the caller. A nil
+// channel (health checking disabled, or the controller hasn't finished starting) is a no-op.
+func SendHeartBeat(healthChan chan<- *ControllerHeartbeat, component string) {
+	if healthChan == nil {
+		return
+	}
+	heartbeat := &ControllerHeartbeat{
+		Component:     component,
+		LastHeartBeat: time.Now(),
+	}
+	select {
+	case healthChan <- heartbeat:
+	default:
+		klog.V(2).InfoS("health check channel is full, skipping heartbeat", "component", component)
+	}
+}
+
+// Controller aggregates heartbeats from every kube-router controller and answers /healthz: 200 if
+// every controller with a timeout set via SetTimeout has reported in within it, 503 otherwise.
+type Controller struct {
+	HealthChan chan *ControllerHeartbeat
+
+	mu       sync.Mutex
+	timeouts map[string]time.Duration
+	lastBeat map[string]time.Time
+}
+
+// NewHealthController creates a Controller with a buffered heartbeat channel
+func NewHealthController() *Controller {
+	return &Controller{
+		HealthChan: make(chan *ControllerHeartbeat, 10),
+		timeouts:   make(map[string]time.Duration),
+		lastBeat:   make(map[string]time.Time),
+	}
+}
+
+// SetTimeout configures how long component is allowed to go without a heartbeat before it is
+// considered unhealthy, typically syncPeriod*2 for a controller with a periodic sync loop
+func (hc *Controller) SetTimeout(component string, timeout time.Duration) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.timeouts[component] = timeout
+}
+
+// RunCheck drains HealthChan and records the last heartbeat per component until stopCh closes
+func (hc *Controller) RunCheck(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case heartbeat := <-hc.HealthChan:
+			hc.mu.Lock()
+			hc.lastBeat[heartbeat.Component] = heartbeat.LastHeartBeat
+			hc.mu.Unlock()
+		}
+	}
+}
+
+// Handler implements the /healthz HTTP endpoint: 200 if every component that has a configured
+// timeout has sent a heartbeat within it, 503 otherwise
+func (hc *Controller) Handler(w http.ResponseWriter, r *http.Request) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	now := time.Now()
+	for component, timeout := range hc.timeouts {
+		last, ok := hc.lastBeat[component]
+		if !ok || now.Sub(last) > timeout {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "controller %s has not reported a heartbeat within %v\n", component, timeout)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "OK\n")
+}
@@ -0,0 +1,66 @@
+// Package metrics holds the prometheus collectors shared by kube-router's controllers. Controllers
+// register the collectors they use with a *prometheus.Registry at startup and instrument their own
+// hot paths; this package only declares the collector instances and their labels/help text so that
+// metric names and buckets stay consistent across controllers.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Namespace is the common prometheus namespace for all kube-router metrics
+const Namespace = "kube_router"
+
+var (
+	// ControllerIptablesSyncTime observes how long a full iptables sync of the network policy
+	// controller takes, in seconds
+	ControllerIptablesSyncTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "controller",
+		Name:      "iptables_sync_duration_seconds",
+		Help:      "Duration of a network policy controller full iptables sync in seconds",
+	})
+
+	// ControllerIptablesSyncTotal counts full iptables syncs performed by the network policy
+	// controller, labeled by outcome
+	ControllerIptablesSyncTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "controller",
+		Name:      "iptables_sync_total",
+		Help:      "Number of network policy controller iptables syncs, by result",
+	}, []string{"result"})
+
+	// ControllerPolicyChainsSyncTime observes how long it takes to sync the per-policy iptables
+	// chains and ipsets during a full sync, in seconds
+	ControllerPolicyChainsSyncTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "controller",
+		Name:      "policy_chains_sync_duration_seconds",
+		Help:      "Duration of syncing network policy iptables chains in seconds",
+	})
+
+	// ControllerPolicyChains is a gauge of the number of active KUBE-NWPLCY-* chains as of the
+	// last full sync
+	ControllerPolicyChains = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "controller",
+		Name:      "policy_chains",
+		Help:      "Number of active network policy iptables chains",
+	})
+
+	// ControllerPodFirewallChains is a gauge of the number of active KUBE-POD-FW-* chains as of the
+	// last full sync, populated from the activePodFwChains map returned by fullSyncPodFirewallChains
+	ControllerPodFirewallChains = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: "controller",
+		Name:      "pod_firewall_chains",
+		Help:      "Number of active pod firewall iptables chains",
+	})
+
+	// ControllerIpsetRestoreTime observes how long ipset refresh calls (a full refresh, or the
+	// incremental add/del of the delta) take during a sync, in seconds; ipset creation is not timed
+	ControllerIpsetRestoreTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "controller",
+		Name:      "ipset_restore_duration_seconds",
+		Help:      "Duration of ipset refresh calls during a network policy sync in seconds",
+	})
+)
@@ -0,0 +1,83 @@
+package utils
+
+import "time"
+
+// BoundedFrequencyRunner invokes fn in response to Run() requests, while guaranteeing at least
+// minInterval between successive invocations and at most maxInterval between them. A burst of Run()
+// calls that arrive faster than minInterval collapses into a single follow-up invocation shortly after
+// the burst settles, instead of queuing (or dropping) every request individually. With no requests at
+// all, fn still runs at least every maxInterval, so it doubles as a periodic sync. This is the same
+// role Kubernetes' async.BoundedFrequencyRunner plays for kube-proxy's iptables sync.
+type BoundedFrequencyRunner struct {
+	minInterval time.Duration
+	maxInterval time.Duration
+	fn          func()
+
+	runRequested chan struct{}
+}
+
+// NewBoundedFrequencyRunner returns a BoundedFrequencyRunner that calls fn per the bounded-frequency
+// contract described on BoundedFrequencyRunner. Call Loop to start it.
+func NewBoundedFrequencyRunner(minInterval, maxInterval time.Duration, fn func()) *BoundedFrequencyRunner {
+	return &BoundedFrequencyRunner{
+		minInterval:  minInterval,
+		maxInterval:  maxInterval,
+		fn:           fn,
+		runRequested: make(chan struct{}, 1),
+	}
+}
+
+// Run requests an invocation of fn without blocking the caller. Any request that arrives while another
+// is already pending is dropped, since once the pending request is serviced fn will reflect whatever
+// state prompted this one too.
+func (bfr *BoundedFrequencyRunner) Run() {
+	select {
+	case bfr.runRequested <- struct{}{}:
+	default:
+	}
+}
+
+// Loop services Run() requests and the maxInterval backstop until stopCh is closed. It blocks, so
+// callers typically start it in its own goroutine.
+func (bfr *BoundedFrequencyRunner) Loop(stopCh <-chan struct{}) {
+	maxTimer := time.NewTimer(bfr.maxInterval)
+	defer maxTimer.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-maxTimer.C:
+			bfr.fn()
+			maxTimer.Reset(bfr.maxInterval)
+		case <-bfr.runRequested:
+			// hold off for minInterval to let the rest of a burst land, draining any further
+			// requests that arrive in the meantime, so the burst collapses into one run; this
+			// also keeps at least minInterval between this run and the previous one
+			if !bfr.waitOrDrain(bfr.minInterval, stopCh) {
+				return
+			}
+			bfr.fn()
+			if !maxTimer.Stop() {
+				<-maxTimer.C
+			}
+			maxTimer.Reset(bfr.maxInterval)
+		}
+	}
+}
+
+// waitOrDrain blocks for wait, discarding any runRequested signals that arrive in the meantime, and
+// returns false if stopCh closes first.
+func (bfr *BoundedFrequencyRunner) waitOrDrain(wait time.Duration, stopCh <-chan struct{}) bool {
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return false
+		case <-t.C:
+			return true
+		case <-bfr.runRequested:
+		}
+	}
+}
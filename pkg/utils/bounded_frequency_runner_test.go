@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBoundedFrequencyRunnerCollapsesBurst(t *testing.T) {
+	var calls int32
+	bfr := NewBoundedFrequencyRunner(50*time.Millisecond, time.Hour, func() {
+		atomic.AddInt32(&calls, 1)
+	})
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bfr.Loop(stopCh)
+	}()
+
+	// a burst of Run() calls arriving faster than minInterval should collapse into one invocation
+	for i := 0; i < 10; i++ {
+		bfr.Run()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(stopCh)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected exactly 1 call for a collapsed burst, got %d", got)
+	}
+}
+
+func TestBoundedFrequencyRunnerMaxIntervalBackstop(t *testing.T) {
+	var calls int32
+	bfr := NewBoundedFrequencyRunner(time.Hour, 50*time.Millisecond, func() {
+		atomic.AddInt32(&calls, 1)
+	})
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bfr.Loop(stopCh)
+	}()
+
+	// with no Run() requests at all, fn must still fire on the maxInterval backstop
+	time.Sleep(180 * time.Millisecond)
+	close(stopCh)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got < 2 {
+		t.Fatalf("expected at least 2 backstop calls within 180ms of a 50ms maxInterval, got %d", got)
+	}
+}
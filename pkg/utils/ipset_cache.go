@@ -0,0 +1,55 @@
+package utils
+
+import "sync"
+
+// ipSetMemberCache tracks the last-known member set of an ipset by name, keyed on the fully-qualified
+// set name, so repeated syncs of the same set only need to apply the delta instead of rebuilding the
+// set's entire member list on every pod event. It is shared by every caller of DiffIPSetMembers, so
+// both network policy chains and pod target sets benefit from the same cache.
+var ipSetMemberCache = struct {
+	mu      sync.Mutex
+	members map[string]map[string]bool
+}{members: make(map[string]map[string]bool)}
+
+// DiffIPSetMembers compares desired against the last-known member set for the ipset name and returns
+// the IPs that need to be added and removed to converge, recording desired as the new last-known
+// state. known is false the first time name is seen (e.g. controller startup, or after a call to
+// InvalidateIPSetMembers), in which case add is simply desired and the caller should fall back to a
+// full create+refresh rather than trust the delta.
+func DiffIPSetMembers(name string, desired []string) (add, del []string, known bool) {
+	ipSetMemberCache.mu.Lock()
+	defer ipSetMemberCache.mu.Unlock()
+
+	desiredSet := make(map[string]bool, len(desired))
+	for _, ip := range desired {
+		desiredSet[ip] = true
+	}
+
+	current, known := ipSetMemberCache.members[name]
+	if known {
+		for ip := range current {
+			if !desiredSet[ip] {
+				del = append(del, ip)
+			}
+		}
+		for ip := range desiredSet {
+			if !current[ip] {
+				add = append(add, ip)
+			}
+		}
+	} else {
+		add = desired
+	}
+
+	ipSetMemberCache.members[name] = desiredSet
+	return add, del, known
+}
+
+// InvalidateIPSetMembers drops the cached member set for name, forcing the next DiffIPSetMembers call
+// to treat it as unseen and return desired entirely as additions. Callers should invalidate a name
+// when an incremental add/del against it fails, since the on-disk set may no longer match the cache.
+func InvalidateIPSetMembers(name string) {
+	ipSetMemberCache.mu.Lock()
+	defer ipSetMemberCache.mu.Unlock()
+	delete(ipSetMemberCache.members, name)
+}
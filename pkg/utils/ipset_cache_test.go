@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sortedStrings(ss []string) []string {
+	out := append([]string(nil), ss...)
+	sort.Strings(out)
+	return out
+}
+
+func TestDiffIPSetMembers(t *testing.T) {
+	name := "KUBE-DST-test1234"
+	defer InvalidateIPSetMembers(name)
+	InvalidateIPSetMembers(name)
+
+	add, del, known := DiffIPSetMembers(name, []string{"10.0.0.1", "10.0.0.2"})
+	if known {
+		t.Fatalf("expected known=false on first sight of %q", name)
+	}
+	if !reflect.DeepEqual(sortedStrings(add), []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("expected add to be the full desired set, got %v", add)
+	}
+	if len(del) != 0 {
+		t.Fatalf("expected no deletions on first sight, got %v", del)
+	}
+
+	add, del, known = DiffIPSetMembers(name, []string{"10.0.0.2", "10.0.0.3"})
+	if !known {
+		t.Fatalf("expected known=true after the set has been seen once")
+	}
+	if !reflect.DeepEqual(add, []string{"10.0.0.3"}) {
+		t.Fatalf("expected add=[10.0.0.3], got %v", add)
+	}
+	if !reflect.DeepEqual(del, []string{"10.0.0.1"}) {
+		t.Fatalf("expected del=[10.0.0.1], got %v", del)
+	}
+
+	add, del, known = DiffIPSetMembers(name, []string{"10.0.0.2", "10.0.0.3"})
+	if !known {
+		t.Fatalf("expected known=true on a repeat call")
+	}
+	if len(add) != 0 || len(del) != 0 {
+		t.Fatalf("expected no delta for an unchanged desired set, got add=%v del=%v", add, del)
+	}
+}
+
+func TestInvalidateIPSetMembers(t *testing.T) {
+	name := "KUBE-SRC-test5678"
+	DiffIPSetMembers(name, []string{"10.0.0.1"})
+	InvalidateIPSetMembers(name)
+
+	add, _, known := DiffIPSetMembers(name, []string{"10.0.0.1"})
+	if known {
+		t.Fatalf("expected known=false after InvalidateIPSetMembers")
+	}
+	if !reflect.DeepEqual(add, []string{"10.0.0.1"}) {
+		t.Fatalf("expected add to be the full desired set after invalidation, got %v", add)
+	}
+	InvalidateIPSetMembers(name)
+}